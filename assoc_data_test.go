@@ -0,0 +1,69 @@
+package lnonion
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+func TestProcessOnionBindsAssocData(t *testing.T) {
+	sessionKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate session key: %v", err)
+	}
+	hopKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate hop key: %v", err)
+	}
+
+	hops := []HopPayload{
+		{PublicKey: hopKey.PubKey(), Payload: []byte("payload")},
+	}
+	assocData := []byte("payment_hash:a")
+
+	onion, err := ConstructOnion(sessionKey, hops, DefaultPacketLen, assocData)
+	if err != nil {
+		t.Fatalf("failed to construct onion: %v", err)
+	}
+
+	if _, _, _, err := ProcessOnion(onion, hopKey, nil, []byte("payment_hash:b")); err == nil {
+		t.Fatal("expected mismatched assoc data to fail hmac validation")
+	}
+
+	hopPayload, _, _, err := ProcessOnion(onion, hopKey, nil, assocData)
+	if err != FinalHop {
+		t.Fatalf("expected FinalHop, got %v", err)
+	}
+	if !bytes.Equal(hopPayload.Payload, []byte("payload")) {
+		t.Fatalf("unexpected payload: %q", hopPayload.Payload)
+	}
+}
+
+func TestNewOnionPacketWithRandomFiller(t *testing.T) {
+	sessionKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate session key: %v", err)
+	}
+	hopKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate hop key: %v", err)
+	}
+
+	hops := []HopPayload{
+		{PublicKey: hopKey.PubKey(), Payload: []byte("payload")},
+	}
+
+	onion, err := NewOnionPacket(sessionKey, hops, DefaultPacketLen, nil, RandomPacketFiller)
+	if err != nil {
+		t.Fatalf("failed to construct onion: %v", err)
+	}
+
+	hopPayload, _, _, err := ProcessOnion(onion, hopKey, nil, nil)
+	if err != FinalHop {
+		t.Fatalf("expected FinalHop, got %v", err)
+	}
+	if !bytes.Equal(hopPayload.Payload, []byte("payload")) {
+		t.Fatalf("unexpected payload: %q", hopPayload.Payload)
+	}
+}
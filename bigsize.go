@@ -0,0 +1,129 @@
+package lnonion
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// EncodeBigSize encodes v using BigSize, the variable-length integer
+// encoding modern Sphinx (and the rest of the Lightning wire protocol) uses
+// for TLV types and lengths: 0-252 fit in a single byte, 253-65535 are
+// prefixed with 0xfd, 65536-4294967295 with 0xfe, and anything larger with
+// 0xff, each followed by the value in big-endian.
+func EncodeBigSize(v uint64) []byte {
+	switch {
+	case v < 0xfd:
+		return []byte{byte(v)}
+	case v <= 0xffff:
+		b := make([]byte, 3)
+		b[0] = 0xfd
+		binary.BigEndian.PutUint16(b[1:], uint16(v))
+		return b
+	case v <= 0xffffffff:
+		b := make([]byte, 5)
+		b[0] = 0xfe
+		binary.BigEndian.PutUint32(b[1:], uint32(v))
+		return b
+	default:
+		b := make([]byte, 9)
+		b[0] = 0xff
+		binary.BigEndian.PutUint64(b[1:], v)
+		return b
+	}
+}
+
+// bigSizeLen returns len(EncodeBigSize(v)) without allocating, so callers
+// can size a payload before encoding it.
+func bigSizeLen(v uint64) int {
+	switch {
+	case v < 0xfd:
+		return 1
+	case v <= 0xffff:
+		return 3
+	case v <= 0xffffffff:
+		return 5
+	default:
+		return 9
+	}
+}
+
+// DecodeBigSize reads a BigSize varint off the front of b, returning the
+// decoded value and the number of bytes it occupied.
+func DecodeBigSize(b []byte) (uint64, int, error) {
+	if len(b) < 1 {
+		return 0, 0, errors.New("bigsize: empty input")
+	}
+
+	switch prefix := b[0]; {
+	case prefix < 0xfd:
+		return uint64(prefix), 1, nil
+	case prefix == 0xfd:
+		if len(b) < 3 {
+			return 0, 0, errors.New("bigsize: truncated 0xfd value")
+		}
+		return uint64(binary.BigEndian.Uint16(b[1:3])), 3, nil
+	case prefix == 0xfe:
+		if len(b) < 5 {
+			return 0, 0, errors.New("bigsize: truncated 0xfe value")
+		}
+		return uint64(binary.BigEndian.Uint32(b[1:5])), 5, nil
+	default:
+		if len(b) < 9 {
+			return 0, 0, errors.New("bigsize: truncated 0xff value")
+		}
+		return binary.BigEndian.Uint64(b[1:9]), 9, nil
+	}
+}
+
+// TLVRecord is a single type/length/value entry in a TLV stream.
+type TLVRecord struct {
+	Type  uint64
+	Value []byte
+}
+
+// EncodeTLV serializes records as a TLV stream, each record framed as
+// BigSize(Type) || BigSize(len(Value)) || Value, sorted by ascending Type
+// as the wire format requires.
+func EncodeTLV(records []TLVRecord) []byte {
+	sorted := make([]TLVRecord, len(records))
+	copy(sorted, records)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Type < sorted[j].Type })
+
+	var out []byte
+	for _, r := range sorted {
+		out = append(out, EncodeBigSize(r.Type)...)
+		out = append(out, EncodeBigSize(uint64(len(r.Value)))...)
+		out = append(out, r.Value...)
+	}
+	return out
+}
+
+// DecodeTLV parses a TLV stream built by EncodeTLV.
+func DecodeTLV(b []byte) ([]TLVRecord, error) {
+	var records []TLVRecord
+
+	for len(b) > 0 {
+		typ, n, err := DecodeBigSize(b)
+		if err != nil {
+			return nil, fmt.Errorf("tlv type: %v", err)
+		}
+		b = b[n:]
+
+		length, n, err := DecodeBigSize(b)
+		if err != nil {
+			return nil, fmt.Errorf("tlv length: %v", err)
+		}
+		b = b[n:]
+
+		if uint64(len(b)) < length {
+			return nil, errors.New("tlv: truncated value")
+		}
+
+		records = append(records, TLVRecord{Type: typ, Value: b[:length]})
+		b = b[length:]
+	}
+
+	return records, nil
+}
@@ -0,0 +1,165 @@
+package lnonion
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+func TestBigSizeRoundTrip(t *testing.T) {
+	values := []uint64{0, 1, 252, 253, 65535, 65536, 4294967295, 4294967296}
+
+	for _, v := range values {
+		encoded := EncodeBigSize(v)
+		decoded, n, err := DecodeBigSize(encoded)
+		if err != nil {
+			t.Fatalf("failed to decode %d: %v", v, err)
+		}
+		if n != len(encoded) {
+			t.Fatalf("value %d: expected to consume %d bytes, consumed %d", v, len(encoded), n)
+		}
+		if decoded != v {
+			t.Fatalf("expected %d, got %d", v, decoded)
+		}
+	}
+}
+
+func TestTLVRoundTrip(t *testing.T) {
+	records := []TLVRecord{
+		{Type: 3, Value: []byte("third")},
+		{Type: 1, Value: bytes.Repeat([]byte{0x42}, 300)},
+	}
+
+	encoded := EncodeTLV(records)
+	decoded, err := DecodeTLV(encoded)
+	if err != nil {
+		t.Fatalf("failed to decode tlv stream: %v", err)
+	}
+
+	if len(decoded) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(decoded))
+	}
+	// EncodeTLV sorts by type, so record 0 should be type 1.
+	if decoded[0].Type != 1 || !bytes.Equal(decoded[0].Value, records[1].Value) {
+		t.Fatalf("unexpected first record: %+v", decoded[0])
+	}
+	if decoded[1].Type != 3 || !bytes.Equal(decoded[1].Value, records[0].Value) {
+		t.Fatalf("unexpected second record: %+v", decoded[1])
+	}
+}
+
+func TestHopPayloadOver255Bytes(t *testing.T) {
+	sessionKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate session key: %v", err)
+	}
+
+	var hopKeys []*secp256k1.PrivateKey
+	var hops []HopPayload
+	largePayload := bytes.Repeat([]byte{0x07}, 400)
+	for i := 0; i < 2; i++ {
+		hopKey, err := secp256k1.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("failed to generate hop key: %v", err)
+		}
+		hopKeys = append(hopKeys, hopKey)
+
+		payload := []byte("small")
+		if i == 0 {
+			payload = largePayload
+		}
+		hops = append(hops, HopPayload{PublicKey: hopKey.PubKey(), Payload: payload})
+	}
+
+	onion, err := ConstructOnion(sessionKey, hops, DefaultPacketLen, nil)
+	if err != nil {
+		t.Fatalf("failed to construct onion: %v", err)
+	}
+
+	hopPayload, next, _, err := ProcessOnion(onion, hopKeys[0], nil, nil)
+	if err != nil {
+		t.Fatalf("failed to process onion at hop 0: %v", err)
+	}
+	if !bytes.Equal(hopPayload.Payload, largePayload) {
+		t.Fatalf("expected a %d-byte payload, got %d bytes", len(largePayload), len(hopPayload.Payload))
+	}
+
+	hopPayload, _, _, err = ProcessOnion(next, hopKeys[1], nil, nil)
+	if err != FinalHop {
+		t.Fatalf("expected FinalHop, got %v", err)
+	}
+	if string(hopPayload.Payload) != "small" {
+		t.Fatalf("expected payload %q, got %q", "small", hopPayload.Payload)
+	}
+}
+
+func TestHopPayloadRecords(t *testing.T) {
+	sessionKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate session key: %v", err)
+	}
+	hopKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate hop key: %v", err)
+	}
+
+	hops := []HopPayload{
+		{
+			PublicKey: hopKey.PubKey(),
+			Records: []TLVRecord{
+				{Type: 2, Value: []byte("amt_to_forward")},
+			},
+		},
+	}
+
+	onion, err := ConstructOnion(sessionKey, hops, DefaultPacketLen, nil)
+	if err != nil {
+		t.Fatalf("failed to construct onion: %v", err)
+	}
+
+	hopPayload, _, _, err := ProcessOnion(onion, hopKey, nil, nil)
+	if err != FinalHop {
+		t.Fatalf("expected FinalHop, got %v", err)
+	}
+	if len(hopPayload.Records) != 1 || hopPayload.Records[0].Type != 2 {
+		t.Fatalf("expected to recover 1 record of type 2, got %+v", hopPayload.Records)
+	}
+	if !bytes.Equal(hopPayload.Records[0].Value, []byte("amt_to_forward")) {
+		t.Fatalf("unexpected record value: %q", hopPayload.Records[0].Value)
+	}
+}
+
+// TestProcessOnionAcceptsAnyPayloadLength guards against reintroducing a
+// length-based heuristic for detecting legacy hop_data: a 64-byte Payload
+// produces a 65-byte wire frame once the flag byte is prepended, which used
+// to be misidentified as the legacy 65-byte hop_data format and rejected
+// even though it's a perfectly valid TLV payload.
+func TestProcessOnionAcceptsAnyPayloadLength(t *testing.T) {
+	sessionKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate session key: %v", err)
+	}
+	hopKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate hop key: %v", err)
+	}
+
+	payload := bytes.Repeat([]byte{0x00}, 64)
+	hops := []HopPayload{
+		{PublicKey: hopKey.PubKey(), Payload: payload},
+	}
+
+	onion, err := ConstructOnion(sessionKey, hops, DefaultPacketLen, nil)
+	if err != nil {
+		t.Fatalf("failed to construct onion: %v", err)
+	}
+
+	hopPayload, _, _, err := ProcessOnion(onion, hopKey, nil, nil)
+	if err != FinalHop {
+		t.Fatalf("expected FinalHop, got %v", err)
+	}
+	if !bytes.Equal(hopPayload.Payload, payload) {
+		t.Fatalf("expected payload %x, got %x", payload, hopPayload.Payload)
+	}
+}
@@ -0,0 +1,160 @@
+package lnonion
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+var blindedNodeID = []byte("blinded_node_id")
+
+// BlindedHop is one entry a sender wants blinded: the real node key of a
+// downstream hop and the data that hop needs to forward the payment (e.g.
+// its next scid/pubkey), which NewBlindedRoute encrypts so only that hop
+// can read it.
+type BlindedHop struct {
+	PublicKey     *secp256k1.PublicKey
+	RecipientData []byte
+}
+
+// BlindedRoute is the result of blinding a route: the introduction node
+// sees BlindedNodeIDs[0] and FirstBlindingKey; every hop forwards the next
+// blinding point (derived locally, or from BlindingOverride) alongside the
+// onion so the next hop can decrypt its EncryptedData entry.
+type BlindedRoute struct {
+	IntroductionNode *secp256k1.PublicKey
+	FirstBlindingKey *secp256k1.PublicKey
+	BlindedNodeIDs   []*secp256k1.PublicKey
+	EncryptedData    [][]byte
+}
+
+// NewBlindedRoute blinds hops, a path starting at an introduction node,
+// using blindingKey as the sender's ephemeral blinding secret E_0. For each
+// hop it derives a shared secret ss_i via ECDH(E_i, hops[i].PublicKey) -
+// the hop's real node key, not a blinded one - then:
+//
+//   - the blinded node id B_i = HMAC-SHA256("blinded_node_id", ss_i) * E_i
+//   - recipient_data encrypted with a stream key derived from ss_i
+//   - the next blinding point E_{i+1} = SHA256(E_i || ss_i) * E_i
+//
+// which is the same hop-key derivation ConstructOnion uses to advance its
+// own ephemeral key, applied here to the blinding point instead.
+func NewBlindedRoute(blindingKey *secp256k1.PrivateKey, hops []BlindedHop) (*BlindedRoute, error) {
+	numHops := len(hops)
+	blindedNodeIDs := make([]*secp256k1.PublicKey, numHops)
+	encryptedData := make([][]byte, numHops)
+
+	firstBlindingKey := blindingKey.PubKey()
+	currentKey := secp256k1.PrivKeyFromBytes(blindingKey.Serialize())
+
+	for i, hop := range hops {
+		blindingPubKey := currentKey.PubKey()
+		sharedSecret := ecdh(currentKey, hop.PublicKey)
+
+		idScalarBytes := generateKey(blindedNodeID, sharedSecret)
+		idScalar := secp256k1.PrivKeyFromBytes(idScalarBytes)
+		var ePoint, bPoint secp256k1.JacobianPoint
+		blindingPubKey.AsJacobian(&ePoint)
+		secp256k1.ScalarMultNonConst(&idScalar.Key, &ePoint, &bPoint)
+		bPoint.ToAffine()
+		blindedNodeIDs[i] = secp256k1.NewPublicKey(&bPoint.X, &bPoint.Y)
+
+		streamKey := generateKey(rho, sharedSecret)
+		stream := generateRandomByteStream(streamKey, len(hop.RecipientData))
+		encrypted := make([]byte, len(hop.RecipientData))
+		xor(encrypted, hop.RecipientData, stream)
+		encryptedData[i] = encrypted
+
+		currentKey = secp256k1.PrivKeyFromBytes(evolvePrivateKey(currentKey, sharedSecret))
+	}
+
+	return &BlindedRoute{
+		IntroductionNode: hops[0].PublicKey,
+		FirstBlindingKey: firstBlindingKey,
+		BlindedNodeIDs:   blindedNodeIDs,
+		EncryptedData:    encryptedData,
+	}, nil
+}
+
+// Serialize encodes route so it can travel as an opaque reply_path blob,
+// e.g. inside an onion message's terminal TLV payload.
+func (r *BlindedRoute) Serialize() []byte {
+	out := append([]byte{}, r.IntroductionNode.SerializeCompressed()...)
+	out = append(out, r.FirstBlindingKey.SerializeCompressed()...)
+	out = append(out, byte(len(r.BlindedNodeIDs)))
+
+	for i, nodeID := range r.BlindedNodeIDs {
+		out = append(out, nodeID.SerializeCompressed()...)
+
+		var dataLen [2]byte
+		binary.BigEndian.PutUint16(dataLen[:], uint16(len(r.EncryptedData[i])))
+		out = append(out, dataLen[:]...)
+		out = append(out, r.EncryptedData[i]...)
+	}
+
+	return out
+}
+
+// DeserializeBlindedRoute parses a route serialized with Serialize.
+func DeserializeBlindedRoute(b []byte) (*BlindedRoute, error) {
+	if len(b) < 33+33+1 {
+		return nil, errors.New("blinded route too short")
+	}
+
+	introductionNode, err := secp256k1.ParsePubKey(b[:33])
+	if err != nil {
+		return nil, fmt.Errorf("invalid introduction node key: %v", err)
+	}
+	firstBlindingKey, err := secp256k1.ParsePubKey(b[33:66])
+	if err != nil {
+		return nil, fmt.Errorf("invalid first blinding key: %v", err)
+	}
+
+	numHops := int(b[66])
+	rest := b[67:]
+
+	blindedNodeIDs := make([]*secp256k1.PublicKey, numHops)
+	encryptedData := make([][]byte, numHops)
+	for i := 0; i < numHops; i++ {
+		if len(rest) < 33+2 {
+			return nil, errors.New("truncated blinded route hop")
+		}
+		nodeID, err := secp256k1.ParsePubKey(rest[:33])
+		if err != nil {
+			return nil, fmt.Errorf("invalid blinded node id: %v", err)
+		}
+		dataLen := binary.BigEndian.Uint16(rest[33:35])
+		rest = rest[35:]
+
+		if len(rest) < int(dataLen) {
+			return nil, errors.New("truncated blinded route hop data")
+		}
+
+		blindedNodeIDs[i] = nodeID
+		encryptedData[i] = rest[:dataLen]
+		rest = rest[dataLen:]
+	}
+
+	return &BlindedRoute{
+		IntroductionNode: introductionNode,
+		FirstBlindingKey: firstBlindingKey,
+		BlindedNodeIDs:   blindedNodeIDs,
+		EncryptedData:    encryptedData,
+	}, nil
+}
+
+// evolvePrivateKey advances priv the same way evolvePoint advances a public
+// blinding point, returning the serialized result so the caller can rebuild
+// a *secp256k1.PrivateKey without holding onto a mutable intermediate.
+func evolvePrivateKey(priv *secp256k1.PrivateKey, secret []byte) []byte {
+	next := secp256k1.PrivKeyFromBytes(priv.Serialize())
+
+	blindingFactorHash := sha256.Sum256(append(priv.PubKey().SerializeCompressed(), secret...))
+	blindingFactor := secp256k1.PrivKeyFromBytes(blindingFactorHash[:])
+	next.Key.Mul(&blindingFactor.Key)
+
+	return next.Serialize()
+}
@@ -0,0 +1,71 @@
+package lnonion
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+func TestBlindedRouteRoundTrip(t *testing.T) {
+	blindingKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate blinding key: %v", err)
+	}
+
+	var hopKeys []*secp256k1.PrivateKey
+	var blindedHops []BlindedHop
+	recipientData := [][]byte{[]byte("next_scid:bob"), []byte("next_scid:dave")}
+	for i := 0; i < 2; i++ {
+		hopKey, err := secp256k1.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("failed to generate hop key: %v", err)
+		}
+		hopKeys = append(hopKeys, hopKey)
+		blindedHops = append(blindedHops, BlindedHop{
+			PublicKey:     hopKey.PubKey(),
+			RecipientData: recipientData[i],
+		})
+	}
+
+	route, err := NewBlindedRoute(blindingKey, blindedHops)
+	if err != nil {
+		t.Fatalf("failed to build blinded route: %v", err)
+	}
+
+	sessionKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate session key: %v", err)
+	}
+
+	hops := []HopPayload{
+		{PublicKey: hopKeys[0].PubKey(), Payload: route.EncryptedData[0]},
+		{PublicKey: hopKeys[1].PubKey(), Payload: route.EncryptedData[1]},
+	}
+
+	onion, err := ConstructOnion(sessionKey, hops, DefaultPacketLen, nil)
+	if err != nil {
+		t.Fatalf("failed to construct onion: %v", err)
+	}
+
+	blindingPoint := route.FirstBlindingKey
+
+	hopPayload, next, nextBlindingPoint, err := ProcessOnion(onion, hopKeys[0], blindingPoint, nil)
+	if err != nil {
+		t.Fatalf("failed to process onion at hop 0: %v", err)
+	}
+	if !bytes.Equal(hopPayload.Payload, recipientData[0]) {
+		t.Fatalf("expected recipient data %q, got %q", recipientData[0], hopPayload.Payload)
+	}
+	if nextBlindingPoint == nil {
+		t.Fatal("expected a blinding point to forward to hop 1")
+	}
+
+	hopPayload, _, _, err = ProcessOnion(next, hopKeys[1], nextBlindingPoint, nil)
+	if err != FinalHop {
+		t.Fatalf("expected FinalHop at hop 1, got %v", err)
+	}
+	if !bytes.Equal(hopPayload.Payload, recipientData[1]) {
+		t.Fatalf("expected recipient data %q, got %q", recipientData[1], hopPayload.Payload)
+	}
+}
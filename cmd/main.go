@@ -53,13 +53,39 @@ func main() {
 }
 
 var onionCmd = &cli.Command{
-	Name:   "onion",
-	Usage:  "build onion",
+	Name:  "onion",
+	Usage: "build onion",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "assoc-data",
+			Usage: "hex-encoded associated data (e.g. payment hash) to bind the onion's HMACs to",
+		},
+		&cli.StringFlag{
+			Name:  "filler",
+			Usage: "packet filler to use: random or deterministic",
+			Value: "deterministic",
+		},
+	},
 	Before: setupKeys,
 	Action: buildOnion,
 }
 
 func buildOnion(ctx *cli.Context) error {
+	assocData, err := hex.DecodeString(ctx.String("assoc-data"))
+	if err != nil {
+		return fmt.Errorf("invalid assoc-data: %v", err)
+	}
+
+	var filler lnonion.PacketFiller
+	switch ctx.String("filler") {
+	case "random":
+		filler = lnonion.RandomPacketFiller
+	case "deterministic":
+		filler = lnonion.DeterministicPacketFiller
+	default:
+		return errors.New("invalid filler: must be random or deterministic")
+	}
+
 	sessionKey, err := secp256k1.GeneratePrivateKey()
 	if err != nil {
 		return err
@@ -91,7 +117,7 @@ func buildOnion(ctx *cli.Context) error {
 		{PublicKey: dave.PubKey(), Payload: []byte(davePayload)},
 	}
 
-	onion, err := lnonion.ConstructOnion(sessionKey, hops)
+	onion, err := lnonion.NewOnionPacket(sessionKey, hops, lnonion.DefaultPacketLen, assocData, filler)
 	if err != nil {
 		return err
 	}
@@ -110,6 +136,10 @@ var parseCmd = &cli.Command{
 			Name:  "hop",
 			Usage: "specify hop (bob, charlie or dave) from which to parse onion",
 		},
+		&cli.StringFlag{
+			Name:  "assoc-data",
+			Usage: "hex-encoded associated data the onion was built with",
+		},
 	},
 	Before: setupKeys,
 	Action: parseOnion,
@@ -121,6 +151,11 @@ func parseOnion(ctx *cli.Context) error {
 		return errors.New("pass an onion to parse")
 	}
 
+	assocData, err := hex.DecodeString(ctx.String("assoc-data"))
+	if err != nil {
+		return fmt.Errorf("invalid assoc-data: %v", err)
+	}
+
 	hop := ctx.String("hop")
 
 	var hopKey *secp256k1.PrivateKey
@@ -145,7 +180,7 @@ func parseOnion(ctx *cli.Context) error {
 		return err
 	}
 
-	payloadForHop, onionToForward, err := lnonion.ProcessOnion(onion, hopKey)
+	payloadForHop, onionToForward, _, err := lnonion.ProcessOnion(onion, hopKey, nil, assocData)
 	if errors.Is(err, lnonion.FinalHop) {
 		fmt.Printf("payload for %v: %s\n", hop, payloadForHop.Payload)
 		fmt.Println("this is the onion's final destination")
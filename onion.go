@@ -3,6 +3,7 @@ package lnonion
 import (
 	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -14,52 +15,180 @@ import (
 var FinalHop = errors.New("final destination of onion")
 
 func (h HopPayload) Size() int {
-	// 1 byte for the encoded payload length (assuming length is < 255)
-	// plus actual bytes of payload + 32 bytes for the hmac
-	return 1 + len(h.Payload) + 32
+	wire := h.wireBytes()
+	return bigSizeLen(uint64(len(wire))) + len(wire) + 32
 }
 
+// PayloadType tags the framing of a HopPayload's contents so future formats
+// can be added without an ambiguous wire representation.
+type PayloadType byte
+
+const (
+	// PayloadTypeTLV is the only format this codebase produces or reads.
+	PayloadTypeTLV PayloadType = 0x01
+)
+
 type HopPayload struct {
-	PublicKey *secp256k1.PublicKey
-	Payload   []byte
+	PublicKey   *secp256k1.PublicKey
+	Payload     []byte
+	PayloadType PayloadType
+
+	// Records, when set, is encoded into Payload as a TLV stream instead
+	// of using Payload directly. ProcessOnion fills it in as a
+	// convenience whenever the decrypted Payload happens to parse as
+	// TLV.
+	Records []TLVRecord
+
+	// BlindingOverride, when set, replaces the blinding point a hop would
+	// otherwise derive for the next hop in a blinded route. Only the
+	// sender sets this; see BlindedRoute.
+	BlindingOverride *secp256k1.PublicKey
+}
+
+// wireBytes is what actually gets packed into the onion for this hop: a
+// flag byte for BlindingOverride, optionally followed by the override
+// itself, then the hop's payload - Records, TLV-encoded, if set, else the
+// raw Payload bytes.
+func (h HopPayload) wireBytes() []byte {
+	payload := h.Payload
+	if len(h.Records) > 0 {
+		payload = EncodeTLV(h.Records)
+	}
+
+	if h.BlindingOverride == nil {
+		return append([]byte{0x00}, payload...)
+	}
+
+	wire := append([]byte{0x01}, h.BlindingOverride.SerializeCompressed()...)
+	return append(wire, payload...)
+}
+
+// parseWireBytes splits wire (as packed by wireBytes) back into an optional
+// blinding override and the hop's payload. wire's total length carries no
+// meaning of its own - only the leading flag byte does - so, unlike an
+// earlier version of this function, length is never used to guess at a
+// pre-TLV "hop_data" framing: every hop payload this codebase produces or
+// consumes goes through wireBytes/parseWireBytes, which never emits the
+// legacy format, so there is no length a genuine TLV payload can't
+// legitimately take.
+func parseWireBytes(wire []byte) (*secp256k1.PublicKey, []byte, error) {
+	if len(wire) < 1 {
+		return nil, nil, errors.New("empty hop payload")
+	}
+
+	switch wire[0] {
+	case 0x00:
+		return nil, wire[1:], nil
+	case 0x01:
+		if len(wire) < 34 {
+			return nil, nil, errors.New("truncated blinding override")
+		}
+		override, err := secp256k1.ParsePubKey(wire[1:34])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid blinding override: %v", err)
+		}
+		return override, wire[34:], nil
+	default:
+		return nil, nil, fmt.Errorf("unknown hop payload framing byte: %#x", wire[0])
+	}
 }
 
+// DefaultPacketLen is the HopPayloads size used by the payment onion (the
+// 1300-byte "hop_payloads" field from BOLT-4). Other onion modes, like
+// onionmsg, construct with a different packet length.
+const DefaultPacketLen = 1300
+
 type Onion struct {
-	Version     byte
-	Point       [33]byte
-	HopPayloads [1300]byte
+	Version byte
+	Point   [33]byte
+	// HopPayloads is PacketLen bytes, where PacketLen is whatever length
+	// ConstructOnion built this onion with.
+	HopPayloads []byte
 	Hmac        [32]byte
 }
 
 func (o Onion) Serialize() []byte {
-	var packet = [1366]byte{o.Version}
-	copy(packet[1:34], o.Point[:])
-	copy(packet[34:1334], o.HopPayloads[:])
-	copy(packet[1334:], o.Hmac[:])
-	return packet[:]
+	packet := make([]byte, 0, 1+33+len(o.HopPayloads)+32)
+	packet = append(packet, o.Version)
+	packet = append(packet, o.Point[:]...)
+	packet = append(packet, o.HopPayloads...)
+	packet = append(packet, o.Hmac[:]...)
+	return packet
 }
 
+// DeserializeOnion parses a DefaultPacketLen-sized onion packet.
 func DeserializeOnion(b []byte) (*Onion, error) {
-	if len(b) != 1366 {
-		return nil, errors.New("onion must be 1366 bytes")
+	return DeserializeOnionWithLen(b, DefaultPacketLen)
+}
+
+// DeserializeOnionWithLen parses an onion packet whose HopPayloads is
+// packetLen bytes, the counterpart to ConstructOnion's packetLen argument.
+func DeserializeOnionWithLen(b []byte, packetLen int) (*Onion, error) {
+	wantLen := 1 + 33 + packetLen + 32
+	if len(b) != wantLen {
+		return nil, fmt.Errorf("onion must be %d bytes", wantLen)
 	}
 
 	onion := &Onion{}
 	onion.Version = b[0]
 	copy(onion.Point[:], b[1:34])
-	copy(onion.HopPayloads[:], b[34:1334])
-	copy(onion.Hmac[:], b[1334:])
+	onion.HopPayloads = make([]byte, packetLen)
+	copy(onion.HopPayloads, b[34:34+packetLen])
+	copy(onion.Hmac[:], b[34+packetLen:])
 
 	return onion, nil
 }
 
-func ConstructOnion(sessionKey *secp256k1.PrivateKey, hops []HopPayload) (*Onion, error) {
+// PacketFiller produces the packetLen bytes of initial padding NewOnionPacket
+// seeds the onion with before each hop's payload is shifted in, given the
+// packet length and the sender's first shared secret (sharedSecrets[0]).
+type PacketFiller func(packetLen int, firstSharedSecret []byte) []byte
+
+// DeterministicPacketFiller derives the initial padding from
+// generateKey(pad, firstSharedSecret), the same ChaCha20 stream
+// ConstructOnion has always used. It is reproducible given the same session
+// key and hops, which reproducible test vectors rely on.
+func DeterministicPacketFiller(packetLen int, firstSharedSecret []byte) []byte {
+	padKey := generateKey(pad, firstSharedSecret)
+	return generateRandomByteStream(padKey, packetLen)
+}
+
+// RandomPacketFiller draws the initial padding from crypto/rand instead of
+// firstSharedSecret, so the padding can't be reconstructed if the pad key is
+// later compromised. Preferred in production; callers that need
+// reproducible test vectors should use DeterministicPacketFiller.
+func RandomPacketFiller(packetLen int, firstSharedSecret []byte) []byte {
+	b := make([]byte, packetLen)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// ConstructOnion builds an onion addressed to hops, with a HopPayloads of
+// packetLen bytes, bound to assocData (e.g. a payment hash) so the onion
+// can't be replayed against a different context. It is a convenience
+// wrapper around NewOnionPacket using DeterministicPacketFiller; use
+// NewOnionPacket directly to pick a different filler. Use DefaultPacketLen
+// for the standard payment onion; other onion modes (e.g. onionmsg) pick a
+// larger packetLen to fit bigger per-hop payloads.
+func ConstructOnion(sessionKey *secp256k1.PrivateKey, hops []HopPayload, packetLen int, assocData []byte) (*Onion, error) {
+	return NewOnionPacket(sessionKey, hops, packetLen, assocData, DeterministicPacketFiller)
+}
+
+// NewOnionPacket is ConstructOnion with the initial packet padding generated
+// by filler instead of always being derived deterministically from
+// sharedSecrets[0].
+func NewOnionPacket(sessionKey *secp256k1.PrivateKey, hops []HopPayload, packetLen int, assocData []byte, filler PacketFiller) (*Onion, error) {
 	numHops := len(hops)
 	ephemeralPublicKeys := make([]*secp256k1.PublicKey, numHops)
 	sharedSecrets := make([][]byte, numHops)
 	blindingFactors := make([]*secp256k1.PrivateKey, numHops)
 
-	currentkey := sessionKey
+	// clone the session key so that deriving the per-hop blinding factors
+	// below does not mutate the key the caller holds (e.g. a sender that
+	// also needs it to call GenerateSharedSecrets)
+	currentkey := secp256k1.PrivKeyFromBytes(sessionKey.Serialize())
 
 	// first need to compute the necessary keys to then construct the onion
 	for i, hop := range hops {
@@ -88,12 +217,11 @@ func ConstructOnion(sessionKey *secp256k1.PrivateKey, hops []HopPayload) (*Onion
 		blindingFactors[i] = blindingFactor
 	}
 
-	// initialize packet with 1300 random bytes
-	padKey := generateKey(pad, sharedSecrets[0])
-	packetBytes := generateRandomByteStream(padKey, 1300)
+	// initialize packet with packetLen bytes of padding
+	packetBytes := filler(packetLen, sharedSecrets[0])
 	nextHmac := make([]byte, 32)
 
-	filler := generateFiller(hops, sharedSecrets)
+	hopFiller := generateFiller(hops, sharedSecrets, packetLen)
 
 	// packet construction is done backwards
 	for i := numHops - 1; i >= 0; i-- {
@@ -102,36 +230,37 @@ func ConstructOnion(sessionKey *secp256k1.PrivateKey, hops []HopPayload) (*Onion
 		// used to generate hmac
 		muKey := generateKey(mu, sharedSecrets[i])
 
-		hopPayloadLength := len(hops[i].Payload)
+		wireBytes := hops[i].wireBytes()
+		lengthPrefix := EncodeBigSize(uint64(len(wireBytes)))
 		shiftSize := hops[i].Size()
 
-		hopPayload := make([]byte, 1, shiftSize)
-		// NOTE: this length is wrong, should be bigsize encoding.
-		hopPayload[0] = byte(hopPayloadLength)
-		hopPayload = append(hopPayload, hops[i].Payload...)
+		hopPayload := make([]byte, 0, shiftSize)
+		hopPayload = append(hopPayload, lengthPrefix...)
+		hopPayload = append(hopPayload, wireBytes...)
 		hopPayload = append(hopPayload, nextHmac...)
 
 		rightShift(packetBytes, shiftSize)
 		copy(packetBytes[:], hopPayload)
 
 		// pseudo-random byte stream xor'd with `hop_payloads`
-		byteStream := generateRandomByteStream(rhoKey, 1300)
+		byteStream := generateRandomByteStream(rhoKey, packetLen)
 		xor(packetBytes, packetBytes, byteStream)
 
 		if i == numHops-1 {
-			copy(packetBytes[len(packetBytes)-len(filler):], filler)
+			copy(packetBytes[len(packetBytes)-len(hopFiller):], hopFiller)
 		}
 
 		hmac := hmac.New(sha256.New, muKey)
 		hmac.Write(packetBytes)
+		hmac.Write(assocData)
 		nextHmac = hmac.Sum(nil)
 	}
 
 	var publickey [33]byte
 	copy(publickey[:], ephemeralPublicKeys[0].SerializeCompressed())
 
-	var hopPayloads [1300]byte
-	copy(hopPayloads[:], packetBytes)
+	hopPayloads := make([]byte, packetLen)
+	copy(hopPayloads, packetBytes)
 
 	var hmac [32]byte
 	copy(hmac[:], nextHmac)
@@ -144,15 +273,49 @@ func ConstructOnion(sessionKey *secp256k1.PrivateKey, hops []HopPayload) (*Onion
 	}, nil
 }
 
-func ProcessOnion(onion *Onion, hopPrivateKey *secp256k1.PrivateKey) (*HopPayload, *Onion, error) {
+// GenerateSharedSecrets recomputes the per-hop shared secrets that
+// ConstructOnion derives for sessionKey and hops, in path order. The sender
+// keeps these around to later peel a returned onion error and attribute it
+// to the hop that produced it.
+func GenerateSharedSecrets(sessionKey *secp256k1.PrivateKey, hops []HopPayload) ([][]byte, error) {
+	sharedSecrets := make([][]byte, len(hops))
+
+	currentkey := secp256k1.PrivKeyFromBytes(sessionKey.Serialize())
+	for i, hop := range hops {
+		var pkpoint, ecdhpoint secp256k1.JacobianPoint
+		hop.PublicKey.AsJacobian(&pkpoint)
+		secp256k1.ScalarMultNonConst(&currentkey.Key, &pkpoint, &ecdhpoint)
+		ecdhpoint.ToAffine()
+		ecdhkey := secp256k1.NewPublicKey(&ecdhpoint.X, &ecdhpoint.Y)
+		sharedSecret := sha256.Sum256(ecdhkey.SerializeCompressed())
+
+		blindingFactorHash := sha256.Sum256(append(currentkey.PubKey().SerializeCompressed(), sharedSecret[:]...))
+		blindingFactor := secp256k1.PrivKeyFromBytes(blindingFactorHash[:])
+		currentkey.Key.Mul(&blindingFactor.Key)
+
+		sharedSecrets[i] = sharedSecret[:]
+	}
+
+	return sharedSecrets, nil
+}
+
+// ProcessOnion peels one hop off onion. assocData must be the same value the
+// sender passed to ConstructOnion/NewOnionPacket (e.g. the payment hash),
+// binding the onion to that context so it can't be replayed against a
+// different one. blindingPoint is non-nil when this hop is part of a
+// blinded route (see BlindedRoute): it is the current blinding point E this
+// hop received out-of-band, used to derive the blinded shared secret needed
+// to decrypt the hop's recipient_data. It returns the blinding point to
+// forward to the next hop, or nil if this route isn't blinded.
+func ProcessOnion(onion *Onion, hopPrivateKey *secp256k1.PrivateKey, blindingPoint *secp256k1.PublicKey, assocData []byte) (*HopPayload, *Onion, *secp256k1.PublicKey, error) {
 	if onion.Version != 0x00 {
-		return nil, nil, errors.New("incorrect version")
+		return nil, nil, nil, errors.New("incorrect version")
 	}
 
 	// ephemeral public key that will be used for deriving the shared secret
 	pubkey, err := secp256k1.ParsePubKey(onion.Point[:])
 	if err != nil {
-		return nil, nil, fmt.Errorf("invalid public key: %v", err)
+		return nil, nil, nil, fmt.Errorf("invalid public key: %v", err)
 	}
 
 	// shared secret is computed by doing ECDH exchange with the ephemeral public key
@@ -170,59 +333,83 @@ func ProcessOnion(onion *Onion, hopPrivateKey *secp256k1.PrivateKey) (*HopPayloa
 	muKey := generateKey(mu, sharedSecret[:])
 	h := hmac.New(sha256.New, muKey)
 	h.Write(onion.HopPayloads[:])
+	h.Write(assocData)
 	hmacBytes := h.Sum(nil)
 	if !hmac.Equal(hmacBytes, onion.Hmac[:]) {
-		return nil, nil, errors.New("invalid hmac")
+		return nil, nil, nil, errors.New("invalid hmac")
 	}
 
 	// derive bytestream which will then be xor'd with the payload
 	// that will decrypt only the intended payload for this hop.
+	packetLen := len(onion.HopPayloads)
 	rhoKey := generateKey(rho, sharedSecret[:])
-	byteStream := generateRandomByteStream(rhoKey, 2600)
+	byteStream := generateRandomByteStream(rhoKey, 2*packetLen)
 
 	// before doing the xor with generated byte stream
-	// need to pad the hop payload with 1300 zero bytes
-	var unwrappedPayloads [2600]byte
-	copy(unwrappedPayloads[:], onion.HopPayloads[:])
-	xor(unwrappedPayloads[:], unwrappedPayloads[:], byteStream)
-
-	// this length should be encoded
-	payloadLength := unwrappedPayloads[0]
-	if payloadLength < 2 {
-		return nil, nil, errors.New("payload length too short")
+	// need to pad the hop payload with packetLen zero bytes
+	unwrappedPayloads := make([]byte, 2*packetLen)
+	copy(unwrappedPayloads, onion.HopPayloads)
+	xor(unwrappedPayloads, unwrappedPayloads, byteStream)
+
+	payloadLength, prefixLen, err := DecodeBigSize(unwrappedPayloads)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid hop payload length: %v", err)
 	}
 
-	payload := make([]byte, payloadLength)
-	copy(payload, unwrappedPayloads[1:payloadLength+1])
+	wireBytes := make([]byte, payloadLength)
+	copy(wireBytes, unwrappedPayloads[prefixLen:uint64(prefixLen)+payloadLength])
+
+	blindingOverride, payload, err := parseWireBytes(wireBytes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	hopPayload := &HopPayload{
-		PublicKey: hopPrivateKey.PubKey(),
-		Payload:   payload,
+		PublicKey:        hopPrivateKey.PubKey(),
+		Payload:          payload,
+		PayloadType:      PayloadTypeTLV,
+		BlindingOverride: blindingOverride,
 	}
 
-	nextHmac := unwrappedPayloads[1+payloadLength : 1+payloadLength+32]
+	var nextBlindingPoint *secp256k1.PublicKey
+	if blindingPoint != nil {
+		blindedSecret := ecdh(hopPrivateKey, blindingPoint)
+
+		streamKey := generateKey(rho, blindedSecret)
+		stream := generateRandomByteStream(streamKey, len(hopPayload.Payload))
+		decrypted := make([]byte, len(hopPayload.Payload))
+		xor(decrypted, hopPayload.Payload, stream)
+		hopPayload.Payload = decrypted
+
+		if hopPayload.BlindingOverride != nil {
+			nextBlindingPoint = hopPayload.BlindingOverride
+		} else {
+			nextBlindingPoint = evolvePoint(blindingPoint, blindedSecret)
+		}
+	}
+
+	if records, err := DecodeTLV(hopPayload.Payload); err == nil {
+		hopPayload.Records = records
+	}
+
+	hopFrameEnd := prefixLen + int(payloadLength)
+	nextHmac := unwrappedPayloads[hopFrameEnd : hopFrameEnd+32]
 	zeroslice := make([]byte, 32)
 	// if nextHmac is all-zero, then this is the final destination, congrats
 	if bytes.Compare(zeroslice, nextHmac) == 0 {
-		return hopPayload, nil, FinalHop
+		return hopPayload, nil, nextBlindingPoint, FinalHop
 	}
 
-	// derive blinding factor which is the SHA256 of the ephemeral public key and the shared secret
-	blindingFactor := sha256.Sum256(append(pubkey.SerializeCompressed(), sharedSecret[:]...))
-	blindingFactorKey := secp256k1.PrivKeyFromBytes(blindingFactor[:])
-
 	// public key for the next hop is the current ephemeral public key
-	// multiplied by the blinding factor
-	var nextPublicKeyPoint secp256k1.JacobianPoint
-	secp256k1.ScalarMultNonConst(&blindingFactorKey.Key, &pubkeypoint, &nextPublicKeyPoint)
-	nextPublicKeyPoint.ToAffine()
-	nextPublicKey := secp256k1.NewPublicKey(&nextPublicKeyPoint.X, &nextPublicKeyPoint.Y)
+	// multiplied by the blinding factor, which is the SHA256 of the
+	// ephemeral public key and the shared secret
+	nextPublicKey := evolvePoint(pubkey, sharedSecret[:])
 
 	var publicKey [33]byte
 	copy(publicKey[:], nextPublicKey.SerializeCompressed())
 
-	var nextHopPayloads [1300]byte
-	copy(nextHopPayloads[:], unwrappedPayloads[1+payloadLength+32:])
+	nextHopPayloads := make([]byte, packetLen)
+	copy(nextHopPayloads, unwrappedPayloads[hopFrameEnd+32:])
 
 	var hmac [32]byte
 	copy(hmac[:], nextHmac)
@@ -234,7 +421,83 @@ func ProcessOnion(onion *Onion, hopPrivateKey *secp256k1.PrivateKey) (*HopPayloa
 		HopPayloads: nextHopPayloads,
 		Hmac:        hmac,
 	}
-	return hopPayload, nextHopOnion, nil
+	return hopPayload, nextHopOnion, nextBlindingPoint, nil
+}
+
+// ecdh performs the ECDH exchange between priv and pub and hashes the
+// resulting point, the shared-secret derivation ConstructOnion and
+// ProcessOnion both use for the forward onion.
+func ecdh(priv *secp256k1.PrivateKey, pub *secp256k1.PublicKey) []byte {
+	var pubPoint, ecdhPoint secp256k1.JacobianPoint
+	pub.AsJacobian(&pubPoint)
+	secp256k1.ScalarMultNonConst(&priv.Key, &pubPoint, &ecdhPoint)
+	ecdhPoint.ToAffine()
+	ecdhKey := secp256k1.NewPublicKey(&ecdhPoint.X, &ecdhPoint.Y)
+	sharedSecret := sha256.Sum256(ecdhKey.SerializeCompressed())
+	return sharedSecret[:]
+}
+
+// evolvePoint multiplies point by SHA256(point || secret), the blinding
+// factor step used to advance both the forward onion's ephemeral key and a
+// blinded route's blinding point from one hop to the next.
+func evolvePoint(point *secp256k1.PublicKey, secret []byte) *secp256k1.PublicKey {
+	blindingFactorHash := sha256.Sum256(append(point.SerializeCompressed(), secret...))
+	blindingFactor := secp256k1.PrivKeyFromBytes(blindingFactorHash[:])
+
+	var p, next secp256k1.JacobianPoint
+	point.AsJacobian(&p)
+	secp256k1.ScalarMultNonConst(&blindingFactor.Key, &p, &next)
+	next.ToAffine()
+	return secp256k1.NewPublicKey(&next.X, &next.Y)
+}
+
+// DecryptBlindedField decrypts ciphertext (e.g. a BlindedRoute.EncryptedData
+// entry) using the same stream cipher ProcessOnion applies to the whole
+// HopPayload.Payload when given a non-nil blindingPoint. Callers that bundle
+// additional cleartext TLV fields alongside the encrypted field (as
+// onionmsg does, for its terminal-hop message/reply_path) decrypt just that
+// field with this instead of handing blindingPoint to ProcessOnion, which
+// would decrypt the entire Payload.
+func DecryptBlindedField(nodeKey *secp256k1.PrivateKey, blindingPoint *secp256k1.PublicKey, ciphertext []byte) []byte {
+	blindedSecret := ecdh(nodeKey, blindingPoint)
+	streamKey := generateKey(rho, blindedSecret)
+	stream := generateRandomByteStream(streamKey, len(ciphertext))
+	decrypted := make([]byte, len(ciphertext))
+	xor(decrypted, ciphertext, stream)
+	return decrypted
+}
+
+// NextBlindingPoint derives the blinding point to forward to the next hop:
+// override if the payload carried a BlindingOverride, otherwise the result
+// of evolving blindingPoint with ECDH(nodeKey, blindingPoint). This is the
+// same derivation ProcessOnion performs internally when given a non-nil
+// blindingPoint.
+func NextBlindingPoint(nodeKey *secp256k1.PrivateKey, blindingPoint *secp256k1.PublicKey, override *secp256k1.PublicKey) *secp256k1.PublicKey {
+	if override != nil {
+		return override
+	}
+	blindedSecret := ecdh(nodeKey, blindingPoint)
+	return evolvePoint(blindingPoint, blindedSecret)
+}
+
+// SharedSecret derives the same shared secret ProcessOnion would use for
+// onion, without doing the rest of its work. A hop that fails to process
+// onion calls this to build an OnionErrorEncrypter for the failure it wants
+// to report back to the sender.
+func SharedSecret(onion *Onion, hopPrivateKey *secp256k1.PrivateKey) ([]byte, error) {
+	pubkey, err := secp256k1.ParsePubKey(onion.Point[:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+
+	var pubkeypoint, ecdhpoint secp256k1.JacobianPoint
+	pubkey.AsJacobian(&pubkeypoint)
+	secp256k1.ScalarMultNonConst(&hopPrivateKey.Key, &pubkeypoint, &ecdhpoint)
+	ecdhpoint.ToAffine()
+	ecdhkey := secp256k1.NewPublicKey(&ecdhpoint.X, &ecdhpoint.Y)
+	sharedSecret := sha256.Sum256(ecdhkey.SerializeCompressed())
+
+	return sharedSecret[:], nil
 }
 
 // each hop needs to decrypt the routing information intended for it
@@ -243,7 +506,7 @@ func ProcessOnion(onion *Onion, hopPrivateKey *secp256k1.PrivateKey) (*HopPayloa
 // generateFiller will be used by the origin node (sending)
 // to generate the filler that will be generated by each hop
 // so that the HMACs are computed and verified correctly
-func generateFiller(hops []HopPayload, sharedSecrets [][]byte) []byte {
+func generateFiller(hops []HopPayload, sharedSecrets [][]byte, packetLen int) []byte {
 	fillerSize := 0
 	// do not calculate for the last hop since it does not need to generate the HMAC
 	for i := 0; i < len(hops)-1; i++ {
@@ -256,14 +519,14 @@ func generateFiller(hops []HopPayload, sharedSecrets [][]byte) []byte {
 		// is the number of bytes from the onion that have been "processed" until this hop
 		// so that is the number of bytes that the current hop will obfuscate
 		// while decrypting
-		fillerStart := 1300
+		fillerStart := packetLen
 		for _, hop := range hops[:i] {
 			fillerStart -= hop.Size()
 		}
-		fillerEnd := 1300 + hops[i].Size()
+		fillerEnd := packetLen + hops[i].Size()
 
 		rhoKey := generateKey(rho, sharedSecrets[i])
-		byteStream := generateRandomByteStream(rhoKey, 2600)
+		byteStream := generateRandomByteStream(rhoKey, 2*packetLen)
 
 		xor(filler, filler, byteStream[fillerStart:fillerEnd])
 	}
@@ -285,10 +548,11 @@ func generateRandomByteStream(key []byte, numBytes int) []byte {
 }
 
 var (
-	rho = []byte{0x72, 0x68, 0x6f}
-	mu  = []byte{0x6d, 0x75}
-	um  = []byte{0x75, 0x6d}
-	pad = []byte{0x70, 0x61, 0x64}
+	rho   = []byte{0x72, 0x68, 0x6f}
+	mu    = []byte{0x6d, 0x75}
+	um    = []byte{0x75, 0x6d}
+	pad   = []byte{0x70, 0x61, 0x64}
+	ammag = []byte{0x61, 0x6d, 0x6d, 0x61, 0x67}
 )
 
 // generate keys that will be used for encryption and verification:
@@ -296,6 +560,7 @@ var (
 // - mu
 // - um
 // - pad
+// - ammag
 func generateKey(keyType []byte, secret []byte) []byte {
 	hmac := hmac.New(sha256.New, keyType)
 	hmac.Write(secret)
@@ -327,3 +592,15 @@ func rightShift(slice []byte, num int) {
 		slice[i] = 0
 	}
 }
+
+// leftShift shifts the byte-slice by the given number of bytes to the left
+// and 0-fills the resulting gap, the inverse of rightShift: used when
+// peeling one layer of a growing trail to advance to the next one instead
+// of adding a new one.
+func leftShift(slice []byte, num int) {
+	copy(slice, slice[num:])
+
+	for i := len(slice) - num; i < len(slice); i++ {
+		slice[i] = 0
+	}
+}
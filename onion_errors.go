@@ -0,0 +1,209 @@
+package lnonion
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// errorMessageMaxLen is the maximum size of the failure message plus
+	// its padding, mirroring the fixed HopPayloads size of the forward
+	// onion so that an error packet never reveals how many hops it has
+	// travelled through.
+	errorMessageMaxLen = 256
+
+	// errorPacketLen is the size of the obfuscated failure||pad block:
+	// failure_len(2) || failuremessage+pad(256) || hmac(32).
+	errorPacketLen = 2 + errorMessageMaxLen + 32
+
+	// maxErrorHops bounds the number of hold-time slots reserved in an
+	// onion error packet, i.e. the longest route an error can travel.
+	maxErrorHops = 20
+
+	// holdTimeSlotLen is the size of a single hop's hold-time trail entry:
+	// hold_time_ms(8) || hmac(32), the hmac binding the entry to the hop
+	// that stamped it so no other hop can tamper with it undetected.
+	holdTimeSlotLen = 8 + 32
+
+	// onionErrorPacketLen is the full size of an onion error packet: the
+	// failure block plus a hold-time slot per hop, both obfuscated (and,
+	// for the hold-time trail, individually authenticated) the same way.
+	onionErrorPacketLen = errorPacketLen + maxErrorHops*holdTimeSlotLen
+)
+
+var ErrNoErrorSecretMatch = errors.New("could not decrypt onion error: no shared secret matched")
+
+// OnionErrorEncrypter obfuscates a return-path error with the shared secret
+// a hop derived while processing the onion, mirroring the ammag/rho key
+// split used by the forward onion.
+type OnionErrorEncrypter struct {
+	sharedSecret []byte
+}
+
+func NewOnionErrorEncrypter(sharedSecret []byte) *OnionErrorEncrypter {
+	return &OnionErrorEncrypter{sharedSecret: sharedSecret}
+}
+
+// EncryptFailure is called by the hop that encountered the failure. It
+// builds a fresh onion error packet carrying failureMessage, keyed off the
+// hop's shared secret, and stamps
+// this hop's holdTimeMs as the first entry of the packet's hold-time trail.
+func (e *OnionErrorEncrypter) EncryptFailure(failureMessage []byte, holdTimeMs uint64) ([]byte, error) {
+	if len(failureMessage) > errorMessageMaxLen {
+		return nil, fmt.Errorf("failure message exceeds %d bytes", errorMessageMaxLen)
+	}
+
+	payload := make([]byte, 2, errorPacketLen-32)
+	binary.BigEndian.PutUint16(payload[:2], uint16(len(failureMessage)))
+	payload = append(payload, failureMessage...)
+	payload = append(payload, make([]byte, errorMessageMaxLen-len(failureMessage))...)
+
+	umKey := generateKey(um, e.sharedSecret)
+	h := hmac.New(sha256.New, umKey)
+	h.Write(payload)
+
+	packet := make([]byte, onionErrorPacketLen)
+	copy(packet, payload)
+	copy(packet[len(payload):errorPacketLen], h.Sum(nil))
+
+	e.stampHoldTime(packet, holdTimeMs)
+	e.obfuscate(packet)
+
+	return packet, nil
+}
+
+// ForwardFailure is called by an upstream hop relaying a failure it did not
+// originate: it prepends its own holdTimeMs to the packet's hold-time trail
+// and then layers on its own ammag obfuscation over the whole packet, so
+// that an upstream hop can never read (or tamper undetectably with) a
+// hold-time entry it didn't itself just stamp.
+func (e *OnionErrorEncrypter) ForwardFailure(packet []byte, holdTimeMs uint64) ([]byte, error) {
+	if len(packet) != onionErrorPacketLen {
+		return nil, fmt.Errorf("onion error packet must be %d bytes", onionErrorPacketLen)
+	}
+
+	out := make([]byte, onionErrorPacketLen)
+	copy(out, packet)
+
+	e.stampHoldTime(out, holdTimeMs)
+	e.obfuscate(out)
+
+	return out, nil
+}
+
+// obfuscate XORs the entire packet - the failure block and the hold-time
+// trail alike - with a pseudo-random stream derived from the hop's shared
+// secret, the same way each hop layers its own obfuscation onto the
+// forward onion.
+func (e *OnionErrorEncrypter) obfuscate(packet []byte) {
+	ammagKey := generateKey(ammag, e.sharedSecret)
+	stream := generateRandomByteStream(ammagKey, onionErrorPacketLen)
+	xor(packet, packet, stream)
+}
+
+// stampHoldTime prepends holdTimeMs, authenticated with this hop's own um
+// key, onto the packet's hold-time trail, right-shifting older entries and
+// dropping the oldest one, the same way rightShift grows HopPayloads onto
+// the forward onion. This must run before obfuscate so the XOR pass also
+// covers the freshly stamped slot; the resulting hmac binds the entry to
+// this hop's shared secret, so no other hop can forge or alter it without
+// detection once the sender peels the packet back open.
+func (e *OnionErrorEncrypter) stampHoldTime(packet []byte, holdTimeMs uint64) {
+	trail := packet[errorPacketLen:]
+	rightShift(trail, holdTimeSlotLen)
+
+	binary.BigEndian.PutUint64(trail[:8], holdTimeMs)
+
+	umKey := generateKey(um, e.sharedSecret)
+	h := hmac.New(sha256.New, umKey)
+	h.Write(trail[:8])
+	copy(trail[8:holdTimeSlotLen], h.Sum(nil))
+}
+
+// DecryptedError is the failure a sender recovered after peeling an onion
+// error packet, along with the per-hop latency it can use to attribute
+// where time was spent along the route.
+type DecryptedError struct {
+	// Sender is the index, in path order, of the hop that reported the
+	// failure.
+	Sender int
+	// Message is the cleartext failure message that hop produced.
+	Message []byte
+	// HoldTimesMs is the hold time, in path order, reported by every hop
+	// from the sender up to and including the failing hop.
+	HoldTimesMs []uint64
+}
+
+// OnionErrorDecrypter peels a returned onion error packet by trying the
+// sender's session-derived shared secrets in path order, the reverse of the
+// order ForwardFailure/EncryptFailure applied them on the way back.
+type OnionErrorDecrypter struct {
+	sharedSecrets [][]byte
+}
+
+func NewOnionErrorDecrypter(sharedSecrets [][]byte) *OnionErrorDecrypter {
+	return &OnionErrorDecrypter{sharedSecrets: sharedSecrets}
+}
+
+// DecryptError peels packet, identifying the failing hop by matching HMAC
+// once the right number of ammag streams have been XOR'd off. Each peel
+// also reveals that hop's own hold-time trail entry; its hmac is checked
+// immediately (using the same shared secret, so a hop that didn't
+// originate an entry could never have produced one that verifies), which
+// is what makes the trail tamper-evident rather than a cleartext
+// appendage an upstream hop could rewrite undetected.
+func (d *OnionErrorDecrypter) DecryptError(packet []byte) (*DecryptedError, error) {
+	if len(packet) != onionErrorPacketLen {
+		return nil, fmt.Errorf("onion error packet must be %d bytes", onionErrorPacketLen)
+	}
+
+	buf := make([]byte, onionErrorPacketLen)
+	copy(buf, packet)
+
+	var holdTimes []uint64
+	for i, sharedSecret := range d.sharedSecrets {
+		ammagKey := generateKey(ammag, sharedSecret)
+		stream := generateRandomByteStream(ammagKey, onionErrorPacketLen)
+		xor(buf, buf, stream)
+
+		umKey := generateKey(um, sharedSecret)
+
+		trailSlot := buf[errorPacketLen : errorPacketLen+holdTimeSlotLen]
+		hTrail := hmac.New(sha256.New, umKey)
+		hTrail.Write(trailSlot[:8])
+		if !hmac.Equal(hTrail.Sum(nil), trailSlot[8:holdTimeSlotLen]) {
+			// this hop's hold-time entry doesn't authenticate under its own
+			// shared secret: either the candidate secrets are wrong, or the
+			// entry was tampered with upstream. Either way, the packet
+			// can't be trusted any further.
+			return nil, ErrNoErrorSecretMatch
+		}
+		holdTimes = append(holdTimes, binary.BigEndian.Uint64(trailSlot[:8]))
+
+		failureLen := binary.BigEndian.Uint16(buf[:2])
+		if int(failureLen) <= errorMessageMaxLen {
+			h := hmac.New(sha256.New, umKey)
+			h.Write(buf[:2+errorMessageMaxLen])
+			if hmac.Equal(h.Sum(nil), buf[2+errorMessageMaxLen:errorPacketLen]) {
+				message := make([]byte, failureLen)
+				copy(message, buf[2:2+failureLen])
+
+				return &DecryptedError{
+					Sender:      i,
+					Message:     message,
+					HoldTimesMs: holdTimes,
+				}, nil
+			}
+		}
+
+		// not the failing hop: shift the trail left so the next hop's
+		// still-enciphered slot lands at the front, mirroring the way
+		// ProcessOnion shifts HopPayloads down for the next hop's frame.
+		leftShift(buf[errorPacketLen:], holdTimeSlotLen)
+	}
+
+	return nil, ErrNoErrorSecretMatch
+}
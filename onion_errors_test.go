@@ -0,0 +1,187 @@
+package lnonion
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+func TestOnionErrorRoundTrip(t *testing.T) {
+	sessionKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate session key: %v", err)
+	}
+
+	var hopKeys []*secp256k1.PrivateKey
+	var hops []HopPayload
+	for i := 0; i < 3; i++ {
+		hopKey, err := secp256k1.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("failed to generate hop key: %v", err)
+		}
+		hopKeys = append(hopKeys, hopKey)
+		hops = append(hops, HopPayload{
+			PublicKey: hopKey.PubKey(),
+			Payload:   []byte("payload"),
+		})
+	}
+
+	sharedSecrets, err := GenerateSharedSecrets(sessionKey, hops)
+	if err != nil {
+		t.Fatalf("failed to generate shared secrets: %v", err)
+	}
+
+	onion, err := ConstructOnion(sessionKey, hops, DefaultPacketLen, nil)
+	if err != nil {
+		t.Fatalf("failed to construct onion: %v", err)
+	}
+
+	// walk the onion to the last hop (index 2), which is the one that
+	// will report the failure.
+	var failingHopSecret []byte
+	for i, hopKey := range hopKeys {
+		hopSecret, err := SharedSecret(onion, hopKey)
+		if err != nil {
+			t.Fatalf("failed to derive shared secret at hop %d: %v", i, err)
+		}
+
+		if i == len(hopKeys)-1 {
+			failingHopSecret = hopSecret
+			break
+		}
+
+		_, next, _, err := ProcessOnion(onion, hopKey, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to process onion at hop %d: %v", i, err)
+		}
+		onion = next
+	}
+
+	failureMessage := []byte("temporary_channel_failure")
+	encrypter := NewOnionErrorEncrypter(failingHopSecret)
+	errorPacket, err := encrypter.EncryptFailure(failureMessage, 42)
+	if err != nil {
+		t.Fatalf("failed to encrypt failure: %v", err)
+	}
+
+	// the error packet now travels back through the upstream hops, each
+	// re-encrypting it and stamping its own hold time.
+	holdTimes := []uint64{7, 3}
+	for i := len(hopKeys) - 2; i >= 0; i-- {
+		hopSecret := sharedSecrets[i]
+		fwd := NewOnionErrorEncrypter(hopSecret)
+		errorPacket, err = fwd.ForwardFailure(errorPacket, holdTimes[i])
+		if err != nil {
+			t.Fatalf("failed to forward failure at hop %d: %v", i, err)
+		}
+	}
+
+	decrypter := NewOnionErrorDecrypter(sharedSecrets)
+	decrypted, err := decrypter.DecryptError(errorPacket)
+	if err != nil {
+		t.Fatalf("failed to decrypt error: %v", err)
+	}
+
+	if decrypted.Sender != 2 {
+		t.Fatalf("expected sender index 2, got %d", decrypted.Sender)
+	}
+	if !bytes.Equal(decrypted.Message, failureMessage) {
+		t.Fatalf("expected message %q, got %q", failureMessage, decrypted.Message)
+	}
+
+	expectedHoldTimes := []uint64{7, 3, 42}
+	if len(decrypted.HoldTimesMs) != len(expectedHoldTimes) {
+		t.Fatalf("expected %d hold times, got %d", len(expectedHoldTimes), len(decrypted.HoldTimesMs))
+	}
+	for i, want := range expectedHoldTimes {
+		if decrypted.HoldTimesMs[i] != want {
+			t.Fatalf("hold time %d: expected %d, got %d", i, want, decrypted.HoldTimesMs[i])
+		}
+	}
+}
+
+// TestOnionErrorHoldTimeTamperDetected guards against an upstream hop
+// rewriting another hop's reported hold time: since the trail lives under
+// the same per-hop ammag obfuscation as the failure block, an upstream hop
+// can't even read another hop's entry in cleartext, and since each entry is
+// individually hmac'd with the hop that stamped it, flipping bits in an
+// entry it does control (or the ciphertext covering one it doesn't) breaks
+// its hmac and the sender refuses to trust the whole packet rather than
+// silently reporting a forged hold time.
+func TestOnionErrorHoldTimeTamperDetected(t *testing.T) {
+	sessionKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate session key: %v", err)
+	}
+
+	var hopKeys []*secp256k1.PrivateKey
+	var hops []HopPayload
+	for i := 0; i < 2; i++ {
+		hopKey, err := secp256k1.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("failed to generate hop key: %v", err)
+		}
+		hopKeys = append(hopKeys, hopKey)
+		hops = append(hops, HopPayload{
+			PublicKey: hopKey.PubKey(),
+			Payload:   []byte("payload"),
+		})
+	}
+
+	sharedSecrets, err := GenerateSharedSecrets(sessionKey, hops)
+	if err != nil {
+		t.Fatalf("failed to generate shared secrets: %v", err)
+	}
+
+	onion, err := ConstructOnion(sessionKey, hops, DefaultPacketLen, nil)
+	if err != nil {
+		t.Fatalf("failed to construct onion: %v", err)
+	}
+
+	failingHopSecret, err := SharedSecret(onion, hopKeys[1])
+	if err != nil {
+		t.Fatalf("failed to derive shared secret at the failing hop: %v", err)
+	}
+
+	encrypter := NewOnionErrorEncrypter(failingHopSecret)
+	errorPacket, err := encrypter.EncryptFailure([]byte("temporary_channel_failure"), 42)
+	if err != nil {
+		t.Fatalf("failed to encrypt failure: %v", err)
+	}
+
+	fwd := NewOnionErrorEncrypter(sharedSecrets[0])
+	errorPacket, err = fwd.ForwardFailure(errorPacket, 7)
+	if err != nil {
+		t.Fatalf("failed to forward failure: %v", err)
+	}
+
+	// hop 0 (upstream of the failure, but downstream on the return path)
+	// flips a bit in the trail region it's relaying onward, without
+	// knowing which bytes belong to which hop's entry.
+	errorPacket[errorPacketLen] ^= 0xff
+
+	decrypter := NewOnionErrorDecrypter(sharedSecrets)
+	if _, err := decrypter.DecryptError(errorPacket); err != ErrNoErrorSecretMatch {
+		t.Fatalf("expected tampering to be detected via %v, got %v", ErrNoErrorSecretMatch, err)
+	}
+}
+
+func TestOnionErrorWrongSecretFails(t *testing.T) {
+	hopSecretArr := sha256.Sum256([]byte("secret"))
+	otherSecretArr := sha256.Sum256([]byte("other"))
+	hopSecret := hopSecretArr[:]
+	otherSecret := otherSecretArr[:]
+
+	encrypter := NewOnionErrorEncrypter(hopSecret)
+	errorPacket, err := encrypter.EncryptFailure([]byte("failure"), 10)
+	if err != nil {
+		t.Fatalf("failed to encrypt failure: %v", err)
+	}
+
+	decrypter := NewOnionErrorDecrypter([][]byte{otherSecret})
+	if _, err := decrypter.DecryptError(errorPacket); err != ErrNoErrorSecretMatch {
+		t.Fatalf("expected %v, got %v", ErrNoErrorSecretMatch, err)
+	}
+}
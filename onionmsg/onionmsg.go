@@ -0,0 +1,124 @@
+// Package onionmsg builds onion messages on top of lnonion's sphinx
+// primitives: unlike a payment onion, a message onion carries an arbitrary
+// application payload (and optionally a reply path) at the terminal hop, so
+// it uses a much larger, fixed packet length instead of the 1300-byte
+// payment onion.
+package onionmsg
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	lnonion "github.com/elnosh/lightning-onion-routing"
+)
+
+// PacketLen is the HopPayloads size onion messages are built with, large
+// enough to carry a terminal message plus a reply path.
+const PacketLen = 32 * 1024
+
+const (
+	tlvEncryptedRecipientData uint64 = 1
+	tlvMessage                uint64 = 2
+	tlvReplyPath              uint64 = 3
+)
+
+// Destination is one hop along a message's path: its real node key and the
+// recipient_data only it can decrypt (via route blinding).
+type Destination struct {
+	PublicKey     *secp256k1.PublicKey
+	RecipientData []byte
+}
+
+// PackMessage builds a message onion to destinations, the path to the
+// recipient, blinding destinations the same way NewBlindedRoute blinds a
+// payment route: each hop only learns its own encrypted_recipient_data and
+// the blinding point to forward, not the hops around it. appPayload is
+// delivered to the last hop in destinations; if replyPath (a route blinded
+// with NewBlindedRoute and serialized) is set, it is delivered alongside
+// appPayload so the recipient can respond. The returned blindingPoint is
+// the first hop's E_0, which must travel to it out-of-band alongside the
+// onion, just as BlindedRoute.FirstBlindingKey does.
+func PackMessage(destinations []Destination, replyPath []byte, appPayload []byte) (onion *lnonion.Onion, blindingPoint *secp256k1.PublicKey, err error) {
+	if len(destinations) == 0 {
+		return nil, nil, errors.New("onionmsg: need at least one destination")
+	}
+
+	blindingKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("onionmsg: failed to generate blinding key: %v", err)
+	}
+
+	blindedHops := make([]lnonion.BlindedHop, len(destinations))
+	for i, dest := range destinations {
+		blindedHops[i] = lnonion.BlindedHop{PublicKey: dest.PublicKey, RecipientData: dest.RecipientData}
+	}
+
+	route, err := lnonion.NewBlindedRoute(blindingKey, blindedHops)
+	if err != nil {
+		return nil, nil, fmt.Errorf("onionmsg: failed to blind route: %v", err)
+	}
+
+	sessionKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("onionmsg: failed to generate session key: %v", err)
+	}
+
+	hops := make([]lnonion.HopPayload, len(destinations))
+	for i, dest := range destinations {
+		records := []lnonion.TLVRecord{{Type: tlvEncryptedRecipientData, Value: route.EncryptedData[i]}}
+
+		if i == len(destinations)-1 {
+			records = append(records, lnonion.TLVRecord{Type: tlvMessage, Value: appPayload})
+			if replyPath != nil {
+				records = append(records, lnonion.TLVRecord{Type: tlvReplyPath, Value: replyPath})
+			}
+		}
+
+		hops[i] = lnonion.HopPayload{
+			PublicKey: dest.PublicKey,
+			Payload:   lnonion.EncodeTLV(records),
+		}
+	}
+
+	onion, err = lnonion.ConstructOnion(sessionKey, hops, PacketLen, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return onion, route.FirstBlindingKey, nil
+}
+
+// HandleMessage processes a message onion at nodeKey, given blindingPoint,
+// the current blinding point for this hop (PackMessage's returned
+// blindingPoint for the first hop, or the nextBlindingPoint a previous hop
+// forwarded). recipientData is this hop's decrypted encrypted_recipient_data
+// entry. If nodeKey is the destination, message (and replyPath, if the
+// sender attached one) are also returned and forward is nil. Otherwise
+// forward is the onion to relay to the next hop, alongside
+// nextBlindingPoint, and message/replyPath are nil.
+func HandleMessage(onion *lnonion.Onion, nodeKey *secp256k1.PrivateKey, blindingPoint *secp256k1.PublicKey) (message, replyPath, recipientData []byte, forward *lnonion.Onion, nextBlindingPoint *secp256k1.PublicKey, err error) {
+	hopPayload, next, _, err := lnonion.ProcessOnion(onion, nodeKey, nil, nil)
+	if err != nil && !errors.Is(err, lnonion.FinalHop) {
+		return nil, nil, nil, nil, nil, err
+	}
+
+	records, decodeErr := lnonion.DecodeTLV(hopPayload.Payload)
+	if decodeErr != nil {
+		return nil, nil, nil, nil, nil, fmt.Errorf("onionmsg: %v", decodeErr)
+	}
+
+	fields := make(map[uint64][]byte, len(records))
+	for _, r := range records {
+		fields[r.Type] = r.Value
+	}
+
+	recipientData = lnonion.DecryptBlindedField(nodeKey, blindingPoint, fields[tlvEncryptedRecipientData])
+
+	if errors.Is(err, lnonion.FinalHop) {
+		return fields[tlvMessage], fields[tlvReplyPath], recipientData, nil, nil, nil
+	}
+
+	nextBlindingPoint = lnonion.NextBlindingPoint(nodeKey, blindingPoint, hopPayload.BlindingOverride)
+	return nil, nil, recipientData, next, nextBlindingPoint, nil
+}
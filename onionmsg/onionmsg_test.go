@@ -0,0 +1,133 @@
+package onionmsg
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	lnonion "github.com/elnosh/lightning-onion-routing"
+)
+
+func TestOnionMessageRoundTrip(t *testing.T) {
+	var nodeKeys []*secp256k1.PrivateKey
+	for i := 0; i < 2; i++ {
+		key, err := secp256k1.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("failed to generate node key: %v", err)
+		}
+		nodeKeys = append(nodeKeys, key)
+	}
+
+	// build a blinded reply path back through the same two hops, in
+	// reverse, that the recipient can use to respond.
+	replyBlindingKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate reply blinding key: %v", err)
+	}
+	replyRoute, err := lnonion.NewBlindedRoute(replyBlindingKey, []lnonion.BlindedHop{
+		{PublicKey: nodeKeys[1].PubKey(), RecipientData: []byte("reply_scid:b")},
+		{PublicKey: nodeKeys[0].PubKey(), RecipientData: []byte("reply_scid:a")},
+	})
+	if err != nil {
+		t.Fatalf("failed to build reply route: %v", err)
+	}
+
+	appPayload := []byte("hello from the sender")
+	recipientDataByHop := [][]byte{[]byte("forward_to:bob"), []byte("terminal")}
+	destinations := []Destination{
+		{PublicKey: nodeKeys[0].PubKey(), RecipientData: recipientDataByHop[0]},
+		{PublicKey: nodeKeys[1].PubKey(), RecipientData: recipientDataByHop[1]},
+	}
+
+	onion, blindingPoint, err := PackMessage(destinations, replyRoute.Serialize(), appPayload)
+	if err != nil {
+		t.Fatalf("failed to pack message: %v", err)
+	}
+
+	message, replyPath, recipientData, forward, nextBlindingPoint, err := HandleMessage(onion, nodeKeys[0], blindingPoint)
+	if err != nil {
+		t.Fatalf("failed to handle message at hop 0: %v", err)
+	}
+	if forward == nil {
+		t.Fatal("expected an onion to forward at hop 0")
+	}
+	if message != nil || replyPath != nil {
+		t.Fatal("intermediate hop should not see the terminal message or reply path")
+	}
+	if !bytes.Equal(recipientData, recipientDataByHop[0]) {
+		t.Fatalf("expected recipient data %q, got %q", recipientDataByHop[0], recipientData)
+	}
+	if nextBlindingPoint == nil {
+		t.Fatal("expected a blinding point to forward to hop 1")
+	}
+
+	// a hop without the right blinding point can still peel the onion (the
+	// encrypted_recipient_data is a separate layer) but must not recover
+	// the real recipient data.
+	wrongBlindingKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate wrong blinding key: %v", err)
+	}
+	_, _, wrongRecipientData, _, _, err := HandleMessage(onion, nodeKeys[0], wrongBlindingKey.PubKey())
+	if err != nil {
+		t.Fatalf("failed to handle message with wrong blinding point: %v", err)
+	}
+	if bytes.Equal(wrongRecipientData, recipientDataByHop[0]) {
+		t.Fatal("expected the wrong blinding point to fail to recover recipient data")
+	}
+
+	message, replyPath, recipientData, forward, _, err = HandleMessage(forward, nodeKeys[1], nextBlindingPoint)
+	if err != nil {
+		t.Fatalf("failed to handle message at hop 1: %v", err)
+	}
+	if forward != nil {
+		t.Fatal("expected no onion to forward at the terminal hop")
+	}
+	if !bytes.Equal(message, appPayload) {
+		t.Fatalf("expected message %q, got %q", appPayload, message)
+	}
+	if !bytes.Equal(recipientData, recipientDataByHop[1]) {
+		t.Fatalf("expected recipient data %q, got %q", recipientDataByHop[1], recipientData)
+	}
+
+	decodedReplyRoute, err := lnonion.DeserializeBlindedRoute(replyPath)
+	if err != nil {
+		t.Fatalf("failed to deserialize reply path: %v", err)
+	}
+	if len(decodedReplyRoute.BlindedNodeIDs) != 2 {
+		t.Fatalf("expected 2 hops in the reply path, got %d", len(decodedReplyRoute.BlindedNodeIDs))
+	}
+}
+
+// TestOnionMessageOver255ByteAppPayload guards against the per-hop TLV
+// framing truncating a terminal hop payload (encrypted_recipient_data +
+// message + reply_path combined) that's over 255 bytes: onion messages are
+// meant to carry an "arbitrary-length" application payload, so this must
+// not silently corrupt.
+func TestOnionMessageOver255ByteAppPayload(t *testing.T) {
+	nodeKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate node key: %v", err)
+	}
+
+	appPayload := bytes.Repeat([]byte{0x07}, 400)
+	destinations := []Destination{
+		{PublicKey: nodeKey.PubKey(), RecipientData: []byte("terminal")},
+	}
+
+	onion, blindingPoint, err := PackMessage(destinations, nil, appPayload)
+	if err != nil {
+		t.Fatalf("failed to pack message: %v", err)
+	}
+
+	message, _, _, forward, _, err := HandleMessage(onion, nodeKey, blindingPoint)
+	if err != nil {
+		t.Fatalf("failed to handle message: %v", err)
+	}
+	if forward != nil {
+		t.Fatal("expected no onion to forward at the terminal hop")
+	}
+	if !bytes.Equal(message, appPayload) {
+		t.Fatalf("expected a %d-byte message, got %d bytes", len(appPayload), len(message))
+	}
+}
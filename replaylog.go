@@ -0,0 +1,213 @@
+package lnonion
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrReplayedPacket is returned by Router.ProcessOnion when an onion's
+// shared secret has already been seen by the Router's ReplayLog, i.e. the
+// packet is being replayed rather than forwarded for the first time. The
+// package-level ProcessOnion takes no ReplayLog and never returns it.
+var ErrReplayedPacket = errors.New("onion packet replayed: shared secret already seen")
+
+// ReplayLog records the shared secrets ProcessOnion has already consumed,
+// so a replayed onion (which decrypts to the exact same shared secret) can
+// be rejected instead of forwarded again. hash is SHA256(sharedSecret); the
+// cltvExpiry stored alongside it lets GC drop entries for HTLCs that have
+// since expired.
+type ReplayLog interface {
+	// Add atomically checks whether hash has already been recorded and, if
+	// not, records it as seen, expiring at cltvExpiry. alreadySeen reports
+	// which of those happened, so callers doing check-and-insert (like
+	// Router.ProcessOnion) don't race between a separate Has and Add.
+	Add(hash [32]byte, cltvExpiry uint32) (alreadySeen bool, err error)
+	// Has reports whether hash has already been recorded.
+	Has(hash [32]byte) (bool, error)
+	// GC drops entries whose cltvExpiry is at or below currentHeight.
+	GC(currentHeight uint32) error
+}
+
+// MemoryReplayLog is a ReplayLog backed by an in-memory map. It does not
+// survive a restart, so a node that needs replay protection across restarts
+// should use BoltReplayLog instead.
+type MemoryReplayLog struct {
+	mu      sync.Mutex
+	entries map[[32]byte]uint32
+}
+
+// NewMemoryReplayLog creates an empty MemoryReplayLog.
+func NewMemoryReplayLog() *MemoryReplayLog {
+	return &MemoryReplayLog{
+		entries: make(map[[32]byte]uint32),
+	}
+}
+
+func (l *MemoryReplayLog) Add(hash [32]byte, cltvExpiry uint32) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, alreadySeen := l.entries[hash]
+	if !alreadySeen {
+		l.entries[hash] = cltvExpiry
+	}
+	return alreadySeen, nil
+}
+
+func (l *MemoryReplayLog) Has(hash [32]byte) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.entries[hash]
+	return ok, nil
+}
+
+func (l *MemoryReplayLog) GC(currentHeight uint32) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for hash, cltvExpiry := range l.entries {
+		if cltvExpiry <= currentHeight {
+			delete(l.entries, hash)
+		}
+	}
+	return nil
+}
+
+// replayBucket is the single bbolt bucket BoltReplayLog keeps its entries
+// in, hash -> big-endian cltvExpiry.
+var replayBucket = []byte("replayed-secrets")
+
+// BoltReplayLog is a ReplayLog backed by a bbolt database file, so a node's
+// replay protection survives a restart.
+type BoltReplayLog struct {
+	db *bolt.DB
+}
+
+// NewBoltReplayLog opens (creating if necessary) a bbolt-backed ReplayLog at
+// path.
+func NewBoltReplayLog(path string) (*BoltReplayLog, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(replayBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltReplayLog{db: db}, nil
+}
+
+// Close closes the underlying bbolt database.
+func (l *BoltReplayLog) Close() error {
+	return l.db.Close()
+}
+
+func (l *BoltReplayLog) Add(hash [32]byte, cltvExpiry uint32) (bool, error) {
+	var alreadySeen bool
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(replayBucket)
+		alreadySeen = bucket.Get(hash[:]) != nil
+		if alreadySeen {
+			return nil
+		}
+		return bucket.Put(hash[:], encodeCltvExpiry(cltvExpiry))
+	})
+	return alreadySeen, err
+}
+
+func (l *BoltReplayLog) Has(hash [32]byte) (bool, error) {
+	var found bool
+	err := l.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(replayBucket)
+		found = bucket.Get(hash[:]) != nil
+		return nil
+	})
+	return found, err
+}
+
+func (l *BoltReplayLog) GC(currentHeight uint32) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(replayBucket)
+		cursor := bucket.Cursor()
+
+		var staleHashes [][]byte
+		for hash, value := cursor.First(); hash != nil; hash, value = cursor.Next() {
+			if decodeCltvExpiry(value) <= currentHeight {
+				staleHashes = append(staleHashes, append([]byte(nil), hash...))
+			}
+		}
+
+		for _, hash := range staleHashes {
+			if err := bucket.Delete(hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func encodeCltvExpiry(cltvExpiry uint32) []byte {
+	b := make([]byte, 4)
+	b[0] = byte(cltvExpiry >> 24)
+	b[1] = byte(cltvExpiry >> 16)
+	b[2] = byte(cltvExpiry >> 8)
+	b[3] = byte(cltvExpiry)
+	return b
+}
+
+func decodeCltvExpiry(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// Router wraps a node's private key and ReplayLog, so callers processing an
+// incoming onion don't have to plumb both through separately.
+type Router struct {
+	NodeKey   *secp256k1.PrivateKey
+	ReplayLog ReplayLog
+}
+
+// NewRouter creates a Router for nodeKey, rejecting replayed onions against
+// replayLog.
+func NewRouter(nodeKey *secp256k1.PrivateKey, replayLog ReplayLog) *Router {
+	return &Router{
+		NodeKey:   nodeKey,
+		ReplayLog: replayLog,
+	}
+}
+
+// ProcessOnion peels one hop off onion using r.NodeKey, rejecting the onion
+// with ErrReplayedPacket if its shared secret has already been recorded in
+// r.ReplayLog. cltvExpiry is the height at which the replay entry can be
+// garbage collected. See the package-level ProcessOnion for the rest of the
+// arguments.
+func (r *Router) ProcessOnion(onion *Onion, blindingPoint *secp256k1.PublicKey, assocData []byte, cltvExpiry uint32) (*HopPayload, *Onion, *secp256k1.PublicKey, error) {
+	sharedSecret, err := SharedSecret(onion, r.NodeKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Add is the atomic check-and-insert: two concurrent deliveries of the
+	// same onion race here, but only one can observe alreadySeen == false,
+	// so exactly one of them proceeds to ProcessOnion below.
+	hash := sha256.Sum256(sharedSecret)
+	alreadySeen, err := r.ReplayLog.Add(hash, cltvExpiry)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if alreadySeen {
+		return nil, nil, nil, ErrReplayedPacket
+	}
+
+	return ProcessOnion(onion, r.NodeKey, blindingPoint, assocData)
+}
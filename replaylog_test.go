@@ -0,0 +1,133 @@
+package lnonion
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+func testReplayLogRejectsReplay(t *testing.T, replayLog ReplayLog) {
+	sessionKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate session key: %v", err)
+	}
+	hopKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate hop key: %v", err)
+	}
+
+	hops := []HopPayload{
+		{PublicKey: hopKey.PubKey(), Payload: []byte("payload")},
+	}
+
+	onion, err := ConstructOnion(sessionKey, hops, DefaultPacketLen, nil)
+	if err != nil {
+		t.Fatalf("failed to construct onion: %v", err)
+	}
+
+	router := NewRouter(hopKey, replayLog)
+
+	if _, _, _, err := router.ProcessOnion(onion, nil, nil, 100); err != FinalHop {
+		t.Fatalf("expected FinalHop on first processing, got %v", err)
+	}
+
+	if _, _, _, err := router.ProcessOnion(onion, nil, nil, 100); err != ErrReplayedPacket {
+		t.Fatalf("expected %v on replay, got %v", ErrReplayedPacket, err)
+	}
+}
+
+func TestMemoryReplayLogRejectsReplay(t *testing.T) {
+	testReplayLogRejectsReplay(t, NewMemoryReplayLog())
+}
+
+func TestBoltReplayLogRejectsReplay(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "replay.db")
+	replayLog, err := NewBoltReplayLog(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open bolt replay log: %v", err)
+	}
+	defer replayLog.Close()
+
+	testReplayLogRejectsReplay(t, replayLog)
+}
+
+func TestMemoryReplayLogGC(t *testing.T) {
+	replayLog := NewMemoryReplayLog()
+	hash := [32]byte{0x01}
+
+	if alreadySeen, err := replayLog.Add(hash, 100); err != nil || alreadySeen {
+		t.Fatalf("failed to add entry: alreadySeen=%v err=%v", alreadySeen, err)
+	}
+
+	if err := replayLog.GC(99); err != nil {
+		t.Fatalf("failed to gc: %v", err)
+	}
+	if seen, _ := replayLog.Has(hash); !seen {
+		t.Fatal("expected entry to survive gc below its cltv expiry")
+	}
+
+	if err := replayLog.GC(100); err != nil {
+		t.Fatalf("failed to gc: %v", err)
+	}
+	if seen, _ := replayLog.Has(hash); seen {
+		t.Fatal("expected entry to be gc'd at its cltv expiry")
+	}
+}
+
+// testReplayLogConcurrentAddIsAtomic fires the same hash through Add from
+// many goroutines at once and asserts exactly one observes alreadySeen ==
+// false, i.e. Add's check-and-insert can't race the way a separate Has then
+// Add would.
+func testReplayLogConcurrentAddIsAtomic(t *testing.T, replayLog ReplayLog) {
+	const goroutines = 50
+	hash := [32]byte{0x02}
+
+	var wg sync.WaitGroup
+	var firstCount int32
+	var mu sync.Mutex
+	errs := make([]error, goroutines)
+
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func(i int) {
+			defer wg.Done()
+			alreadySeen, err := replayLog.Add(hash, 100)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if !alreadySeen {
+				mu.Lock()
+				firstCount++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("goroutine %d: Add failed: %v", i, err)
+		}
+	}
+	if firstCount != 1 {
+		t.Fatalf("expected exactly 1 goroutine to win the race, got %d", firstCount)
+	}
+}
+
+func TestMemoryReplayLogConcurrentAddIsAtomic(t *testing.T) {
+	testReplayLogConcurrentAddIsAtomic(t, NewMemoryReplayLog())
+}
+
+func TestBoltReplayLogConcurrentAddIsAtomic(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "replay-concurrent.db")
+	replayLog, err := NewBoltReplayLog(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open bolt replay log: %v", err)
+	}
+	defer replayLog.Close()
+
+	testReplayLogConcurrentAddIsAtomic(t, replayLog)
+}